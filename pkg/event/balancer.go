@@ -0,0 +1,222 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goodrain/rainbond/pkg/discover/config"
+)
+
+const (
+	//LBRoundRobin 轮询，不考虑权重
+	LBRoundRobin = "round-robin"
+	//LBWeightedRoundRobin 平滑加权轮询，nginx风格
+	LBWeightedRoundRobin = "weighted-round-robin"
+	//LBConsistentHash 一致性hash，保证同一event id落在同一台server
+	LBConsistentHash = "consistent-hash"
+)
+
+//consistentHashReplicas 一致性hash环上每个真实节点对应的虚拟节点数，ketama风格
+const consistentHashReplicas = 160
+
+//Balancer event server负载均衡选择器
+//Pick可能在不持有manager.lock的情况下被调用（drainer.send），与Update/SetAbnormal并发执行，实现需自行加锁保证并发安全
+type Balancer interface {
+	//Pick 根据key（一致性hash下为event id）选出一个可用的server地址
+	Pick(key string) (string, bool)
+	//Update 使用最新的endpoint列表重建负载均衡状态
+	Update(endpoints []*config.Endpoint)
+	//SetAbnormal 标记当前不可用的server，只是跳过，不触发重建
+	SetAbnormal(abnormal map[string]string)
+}
+
+//CreateBalancer 根据策略名称创建Balancer，未知或空策略按round-robin处理
+func CreateBalancer(policy string) Balancer {
+	switch policy {
+	case LBWeightedRoundRobin:
+		return &weightedRoundRobinBalancer{}
+	case LBConsistentHash:
+		return &consistentHashBalancer{}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
+
+//roundRobinBalancer 的servers/abnormal同样需要mutex保护：
+//drainer.send不经过manager.lock直接调用lb.Pick，与UpdateEndpoints/DiscardedLoggerChan的
+//lb.Update/lb.SetAbnormal并发执行，早先两个策略都已经有mutex，这里补齐以消除数据竞争
+type roundRobinBalancer struct {
+	mu       sync.Mutex
+	servers  []string
+	abnormal map[string]string
+	next     int32
+}
+
+func (b *roundRobinBalancer) Update(endpoints []*config.Endpoint) {
+	servers := make([]string, 0, len(endpoints))
+	for _, end := range endpoints {
+		servers = append(servers, end.URL)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.servers = servers
+}
+
+func (b *roundRobinBalancer) SetAbnormal(abnormal map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.abnormal = abnormal
+}
+
+func (b *roundRobinBalancer) Pick(key string) (string, bool) {
+	b.mu.Lock()
+	servers := b.servers
+	abnormal := b.abnormal
+	b.mu.Unlock()
+	total := len(servers)
+	if total == 0 {
+		return "", false
+	}
+	for i := 0; i < total; i++ {
+		index := int(uint32(atomic.AddInt32(&b.next, 1)-1)) % total
+		server := servers[index]
+		if _, ok := abnormal[server]; ok {
+			continue
+		}
+		return server, true
+	}
+	return "", false
+}
+
+type wrrServer struct {
+	addr          string
+	weight        int
+	currentWeight int
+}
+
+type weightedRoundRobinBalancer struct {
+	mu       sync.Mutex
+	servers  []*wrrServer
+	abnormal map[string]string
+}
+
+func (b *weightedRoundRobinBalancer) Update(endpoints []*config.Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	servers := make([]*wrrServer, 0, len(endpoints))
+	for _, end := range endpoints {
+		weight := end.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		servers = append(servers, &wrrServer{addr: end.URL, weight: weight})
+	}
+	b.servers = servers
+}
+
+func (b *weightedRoundRobinBalancer) SetAbnormal(abnormal map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.abnormal = abnormal
+}
+
+//Pick 使用nginx风格的平滑加权轮询：
+//每次为所有正常server的currentWeight累加自身权重，选出currentWeight最大的一个，
+//再将其currentWeight减去全部权重之和，避免权重悬殊时的突发流量
+func (b *weightedRoundRobinBalancer) Pick(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *wrrServer
+	total := 0
+	for _, s := range b.servers {
+		if _, ok := b.abnormal[s.addr]; ok {
+			continue
+		}
+		s.currentWeight += s.weight
+		total += s.weight
+		if best == nil || s.currentWeight > best.currentWeight {
+			best = s
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	best.currentWeight -= total
+	return best.addr, true
+}
+
+type consistentHashBalancer struct {
+	mu       sync.Mutex
+	ring     []uint32
+	nodes    map[uint32]string
+	abnormal map[string]string
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+func (b *consistentHashBalancer) Update(endpoints []*config.Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nodes := make(map[uint32]string, len(endpoints)*consistentHashReplicas)
+	ring := make([]uint32, 0, len(endpoints)*consistentHashReplicas)
+	for _, end := range endpoints {
+		for i := 0; i < consistentHashReplicas; i++ {
+			h := hashKey(end.URL + "-" + strconv.Itoa(i))
+			nodes[h] = end.URL
+			ring = append(ring, h)
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	b.ring = ring
+	b.nodes = nodes
+}
+
+func (b *consistentHashBalancer) SetAbnormal(abnormal map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.abnormal = abnormal
+}
+
+//Pick 在hash环上顺时针查找第一个可用节点，event id相同则必然落在同一节点上，
+//异常节点在环上被跳过而不会触发重建，重建只发生在Update（即UpdateEndpoints）时
+func (b *consistentHashBalancer) Pick(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.ring) == 0 {
+		return "", false
+	}
+	h := hashKey(key)
+	idx := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	for i := 0; i < len(b.ring); i++ {
+		pos := (idx + i) % len(b.ring)
+		server := b.nodes[b.ring[pos]]
+		if _, ok := b.abnormal[server]; ok {
+			continue
+		}
+		return server, true
+	}
+	return "", false
+}
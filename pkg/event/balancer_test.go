@@ -0,0 +1,124 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"testing"
+
+	"github.com/goodrain/rainbond/pkg/discover/config"
+)
+
+func endpoints(urls ...string) []*config.Endpoint {
+	var eps []*config.Endpoint
+	for _, u := range urls {
+		eps = append(eps, &config.Endpoint{Name: u, URL: u, Weight: 1})
+	}
+	return eps
+}
+
+func TestRoundRobinBalancerCyclesServers(t *testing.T) {
+	b := CreateBalancer(LBRoundRobin)
+	b.Update(endpoints("a", "b", "c"))
+	seen := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		server, ok := b.Pick("event-1")
+		if !ok {
+			t.Fatalf("expected a server to be picked")
+		}
+		seen[server]++
+	}
+	for _, server := range []string{"a", "b", "c"} {
+		if seen[server] != 3 {
+			t.Errorf("expected server %s to be picked 3 times, got %d", server, seen[server])
+		}
+	}
+}
+
+func TestRoundRobinBalancerSkipsAbnormal(t *testing.T) {
+	b := CreateBalancer(LBRoundRobin)
+	b.Update(endpoints("a", "b"))
+	b.SetAbnormal(map[string]string{"a": "a"})
+	for i := 0; i < 4; i++ {
+		server, ok := b.Pick("event-1")
+		if !ok {
+			t.Fatalf("expected a server to be picked")
+		}
+		if server == "a" {
+			t.Errorf("abnormal server should never be picked, got %s", server)
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalancerDistributesByWeight(t *testing.T) {
+	b := &weightedRoundRobinBalancer{}
+	b.Update([]*config.Endpoint{
+		{Name: "a", URL: "a", Weight: 3},
+		{Name: "b", URL: "b", Weight: 1},
+	})
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		server, ok := b.Pick("event-1")
+		if !ok {
+			t.Fatalf("expected a server to be picked")
+		}
+		counts[server]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Errorf("expected 3:1 weighted split over 8 picks, got a=%d b=%d", counts["a"], counts["b"])
+	}
+}
+
+func TestConsistentHashBalancerIsSticky(t *testing.T) {
+	b := CreateBalancer(LBConsistentHash)
+	b.Update(endpoints("a", "b", "c", "d"))
+	first, ok := b.Pick("event-123")
+	if !ok {
+		t.Fatalf("expected a server to be picked")
+	}
+	for i := 0; i < 20; i++ {
+		server, ok := b.Pick("event-123")
+		if !ok || server != first {
+			t.Errorf("expected same key to stick to %s, got %s (ok=%v)", first, server, ok)
+		}
+	}
+}
+
+func TestConsistentHashBalancerSkipsAbnormalWithoutRebuild(t *testing.T) {
+	b := CreateBalancer(LBConsistentHash)
+	b.Update(endpoints("a", "b", "c", "d"))
+	first, ok := b.Pick("event-123")
+	if !ok {
+		t.Fatalf("expected a server to be picked")
+	}
+	b.SetAbnormal(map[string]string{first: first})
+	server, ok := b.Pick("event-123")
+	if !ok {
+		t.Fatalf("expected a fallback server to be picked")
+	}
+	if server == first {
+		t.Errorf("abnormal server should have been skipped")
+	}
+	// marking abnormal must not rebuild the ring: once no longer abnormal, the
+	// same key should stick back to the original node
+	b.SetAbnormal(nil)
+	server, ok = b.Pick("event-123")
+	if !ok || server != first {
+		t.Errorf("expected key to stick back to %s once no longer abnormal, got %s (ok=%v)", first, server, ok)
+	}
+}
@@ -0,0 +1,123 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+//errNoAvailableServer 当前没有可用的event log server
+var errNoAvailableServer = errors.New("event: no available event log server")
+
+const (
+	//defaultMaxRetry 重试次数达到该值后进入死信
+	defaultMaxRetry = 5
+	//defaultRetryBaseDelay 指数退避的基础时间
+	defaultRetryBaseDelay = time.Second
+)
+
+//drainer 后台协程，不断读取spool队首记录并投递，
+//只有gRPC Send成功才会推进WAL游标，失败则按asynq式的指数退避+抖动重试，
+//重试次数耗尽后写入死信分段
+type drainer struct {
+	m         *manager
+	sp        *spool
+	ctx       context.Context
+	maxRetry  int
+	baseDelay time.Duration
+	inFlight  int32
+	dead      int32
+}
+
+func newDrainer(ctx context.Context, m *manager, sp *spool, maxRetry int, baseDelay time.Duration) *drainer {
+	if maxRetry <= 0 {
+		maxRetry = defaultMaxRetry
+	}
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+	return &drainer{m: m, sp: sp, ctx: ctx, maxRetry: maxRetry, baseDelay: baseDelay}
+}
+
+//retryDelay 指数退避叠加全量抖动，避免大量失败消息同时重试造成惊群
+func (d *drainer) retryDelay(attempt int) time.Duration {
+	backoff := d.baseDelay * time.Duration(1<<uint(attempt))
+	if backoff > time.Minute {
+		backoff = time.Minute
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+func (d *drainer) run() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+		}
+		rec, ok := d.sp.Head()
+		if !ok {
+			time.Sleep(time.Millisecond * 200)
+			continue
+		}
+		if !rec.NextTry.IsZero() && rec.NextTry.After(time.Now()) {
+			time.Sleep(time.Millisecond * 200)
+			continue
+		}
+		atomic.AddInt32(&d.inFlight, 1)
+		err := d.send(rec)
+		atomic.AddInt32(&d.inFlight, -1)
+		if err == nil {
+			if ackErr := d.sp.Ack(rec.Seq); ackErr != nil {
+				logrus.Error("event spool ack error.", ackErr.Error())
+			}
+			continue
+		}
+		rec.Attempt++
+		if rec.Attempt > d.maxRetry {
+			logrus.Warnf("event spool record seq %d for event %s exceeded max retry, move to dead-letter", rec.Seq, rec.EventID)
+			if dlErr := d.sp.DeadLetter(rec.Seq); dlErr != nil {
+				logrus.Error("event spool dead-letter error.", dlErr.Error())
+			}
+			atomic.AddInt32(&d.dead, 1)
+			continue
+		}
+		rec.NextTry = time.Now().Add(d.retryDelay(rec.Attempt))
+	}
+}
+
+//send 对队首记录做一次同步发送尝试，复用该server对应handle已建立的连接而不是每条记录重新拨号，
+//这样drainer才能在gRPC Send真正返回之后再决定是否推进游标
+func (d *drainer) send(rec *Record) error {
+	server, ok := d.m.lb.Pick(rec.EventID)
+	if !ok {
+		return errNoAvailableServer
+	}
+	h := d.m.getHandle(server)
+	if h == nil {
+		return errNoAvailableServer
+	}
+	return h.SendSync(rec.Payload)
+}
@@ -0,0 +1,247 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//Level 日志级别
+type Level string
+
+const (
+	//LevelInfo info级别
+	LevelInfo Level = "info"
+	//LevelError error级别
+	LevelError Level = "error"
+	//LevelDebug debug级别
+	LevelDebug Level = "debug"
+)
+
+const (
+	//SchemaLegacy 旧版拍平map[string]string格式，向后兼容
+	SchemaLegacy = "v1"
+	//SchemaV2 带版本号的结构化envelope，{"v":2,"ts":...,"lvl":...,"fields":...}
+	SchemaV2 = "v2"
+)
+
+//RequestInfo 请求维度的结构化字段，借鉴Caddy access log的request.*命名
+type RequestInfo struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+//LogEntry 结构化日志条目，取代过去直接拍平到map[string]string里再交给ffjson的写法
+type LogEntry struct {
+	Timestamp time.Time
+	Level     Level
+	Duration  time.Duration
+	EventID   string
+	Component string
+	Message   string
+	Fields    map[string]interface{}
+	Request   *RequestInfo
+	//TenantID 可选的租户标识，设置后且未开启SpoolDir时该条消息由manager的租户公平调度器投递
+	TenantID string
+}
+
+//v2Envelope SchemaV2序列化时使用的版本化信封
+type v2Envelope struct {
+	V         int                    `json:"v"`
+	Timestamp time.Time              `json:"ts"`
+	Level     Level                  `json:"lvl"`
+	EventID   string                 `json:"event_id,omitempty"`
+	Component string                 `json:"component,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Duration  time.Duration          `json:"duration,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Request   *RequestInfo           `json:"request,omitempty"`
+	TenantID  string                 `json:"tenant_id,omitempty"`
+}
+
+//toFlatMap 将LogEntry压成与旧版send()等价的flat map，保持老消费端兼容
+func (e LogEntry) toFlatMap() map[string]string {
+	flat := make(map[string]string, len(e.Fields)+6)
+	flat["event_id"] = e.EventID
+	flat["level"] = string(e.Level)
+	flat["message"] = e.Message
+	flat["time"] = e.Timestamp.Format(time.RFC3339)
+	if e.Component != "" {
+		flat["component"] = e.Component
+	}
+	if e.TenantID != "" {
+		flat["tenant_id"] = e.TenantID
+	}
+	if e.Duration > 0 {
+		flat["duration"] = e.Duration.String()
+	}
+	for k, v := range e.Fields {
+		flat[k] = fmt.Sprintf("%v", v)
+	}
+	if e.Request != nil {
+		if e.Request.Method != "" {
+			flat["request.method"] = e.Request.Method
+		}
+		if e.Request.Path != "" {
+			flat["request.path"] = e.Request.Path
+		}
+		for hk, hv := range e.Request.Headers {
+			flat["request.headers."+hk] = hv
+		}
+	}
+	return flat
+}
+
+//Field 延迟应用到LogEntry上的一个typed上下文字段，用于LoggerWithFields累积per-event上下文
+type Field func(e *LogEntry)
+
+//String 添加一个字符串类型的自定义字段
+func String(key, value string) Field {
+	return func(e *LogEntry) { e.setField(key, value) }
+}
+
+//Int 添加一个整数类型的自定义字段
+func Int(key string, value int) Field {
+	return func(e *LogEntry) { e.setField(key, value) }
+}
+
+//Bool 添加一个布尔类型的自定义字段
+func Bool(key string, value bool) Field {
+	return func(e *LogEntry) { e.setField(key, value) }
+}
+
+//Err 将错误作为error字段附加到LogEntry上
+func Err(err error) Field {
+	return func(e *LogEntry) {
+		if err != nil {
+			e.setField("error", err.Error())
+		}
+	}
+}
+
+//WithComponent 设置LogEntry.Component
+func WithComponent(name string) Field {
+	return func(e *LogEntry) { e.Component = name }
+}
+
+func (e *LogEntry) setField(key string, value interface{}) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]interface{})
+	}
+	e.Fields[key] = value
+}
+
+//FieldType 已知字段的取值类型，供注册表做早期校验
+type FieldType int
+
+const (
+	//FieldTypeString 字符串
+	FieldTypeString FieldType = iota
+	//FieldTypeInt 整数
+	FieldTypeInt
+	//FieldTypeFloat 浮点数
+	FieldTypeFloat
+	//FieldTypeBool 布尔
+	FieldTypeBool
+	//FieldTypeDuration time.Duration
+	FieldTypeDuration
+	//FieldTypeTime time.Time
+	FieldTypeTime
+)
+
+//fieldRegistry 已知Fields字段名到类型的映射，未注册的字段不做强校验
+var fieldRegistry = map[string]FieldType{
+	"error": FieldTypeString,
+}
+
+//RegisterField 注册一个自定义Fields字段的类型约束，供validateEntry早期拒绝畸形条目，
+//重复注册以最后一次为准
+func RegisterField(name string, t FieldType) {
+	fieldRegistry[name] = t
+}
+
+func matchFieldType(t FieldType, v interface{}) bool {
+	switch t {
+	case FieldTypeString:
+		_, ok := v.(string)
+		return ok
+	case FieldTypeInt:
+		switch v.(type) {
+		case int, int32, int64:
+			return true
+		}
+		return false
+	case FieldTypeFloat:
+		switch v.(type) {
+		case float32, float64:
+			return true
+		}
+		return false
+	case FieldTypeBool:
+		_, ok := v.(bool)
+		return ok
+	case FieldTypeDuration:
+		_, ok := v.(time.Duration)
+		return ok
+	case FieldTypeTime:
+		_, ok := v.(time.Time)
+		return ok
+	default:
+		return true
+	}
+}
+
+//validateEntry 对已注册的Fields字段做类型校验，发现不匹配则拒绝该条目
+func validateEntry(entry LogEntry) error {
+	if entry.Level == "" {
+		return errors.New("event: log entry level is required")
+	}
+	for k, v := range entry.Fields {
+		t, ok := fieldRegistry[k]
+		if !ok {
+			continue
+		}
+		if !matchFieldType(t, v) {
+			return fmt.Errorf("event: field %q does not match its registered type", k)
+		}
+	}
+	return nil
+}
+
+//fieldLogger 包装一个Logger，使其携带一组预置Field，
+//Log调用时先把这些Field应用到LogEntry上，实现zerolog风格的一次性typed上下文累积
+type fieldLogger struct {
+	Logger
+	fields []Field
+}
+
+//LoggerWithFields 返回一个携带预置Field的Logger，调用方不必在每次Log时重复传入相同上下文
+func LoggerWithFields(base Logger, fields ...Field) Logger {
+	return &fieldLogger{Logger: base, fields: fields}
+}
+
+func (f *fieldLogger) Log(entry LogEntry) {
+	for _, field := range f.fields {
+		field(&entry)
+	}
+	f.Logger.Log(entry)
+}
@@ -19,6 +19,7 @@
 package event
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -44,22 +45,52 @@ type Manager interface {
 	Start() error
 	Close() error
 	ReleaseLogger(Logger)
+	//Stats 返回落盘队列的积压情况，SpoolDir未设置时始终返回零值
+	Stats() Stats
+	//SetRateLimit 动态调整某个event的限流速率和突发容量
+	SetRateLimit(eventID string, rps, burst int)
 }
 type EventConfig struct {
 	EventLogServers []string
 	DiscoverAddress []string
+	//LBPolicy 负载均衡策略，取值round-robin（默认）、weighted-round-robin、consistent-hash
+	LBPolicy string
+	//SpoolDir 设置后开启基于WAL的落盘重试队列，为空则保持原有内存直发、失败即丢的行为
+	SpoolDir string
+	//MaxRetry 单条消息最大重试次数，超过后进入死信，默认5
+	MaxRetry int
+	//RetryBaseDelay 指数退避的基础时间，默认1秒
+	RetryBaseDelay time.Duration
+	//Schema 序列化协议版本，取值SchemaLegacy（默认，向后兼容的flat map）或SchemaV2（版本化envelope）
+	Schema string
+	//MetricsSink 指标上报目的地，nil表示不上报（no-op）
+	MetricsSink Metrics
+	//RateLimit 每个event的默认限流配置，RPS/Burst均未设置时取200/400
+	RateLimit RateLimitConfig
+}
+
+//Stats manager内部状态统计，用于调用方判断背压
+type Stats struct {
+	Queued   int
+	InFlight int
+	Dead     int
 }
 type manager struct {
 	ctx            context.Context
 	cancel         context.CancelFunc
 	config         EventConfig
-	qos            int32
 	loggers        map[string]Logger
-	handles        map[string]handle
+	handles        map[string]*handle
 	lock           sync.Mutex
 	eventServer    []string
 	abnormalServer map[string]string
 	dis            discover.Discover
+	lb             Balancer
+	sp             *spool
+	drainer        *drainer
+	metrics        Metrics
+	rl             *rateLimiter
+	tenants        *tenantScheduler
 }
 
 var defaultManager Manager
@@ -80,17 +111,35 @@ func NewManager(conf EventConfig) error {
 			return err
 		}
 	}
+	metrics := conf.MetricsSink
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	defaultManager = &manager{
+	m := &manager{
 		ctx:            ctx,
 		cancel:         cancel,
 		config:         conf,
 		loggers:        make(map[string]Logger, 1024),
-		handles:        make(map[string]handle),
+		handles:        make(map[string]*handle),
 		eventServer:    conf.EventLogServers,
 		dis:            dis,
 		abnormalServer: make(map[string]string),
+		lb:             CreateBalancer(conf.LBPolicy),
+		metrics:        metrics,
+		rl:             newRateLimiter(conf.RateLimit),
+		tenants:        newTenantScheduler(),
+	}
+	if conf.SpoolDir != "" {
+		sp, err := newSpool(conf.SpoolDir)
+		if err != nil {
+			logrus.Error("create event spool error.", err.Error())
+			return err
+		}
+		m.sp = sp
+		m.drainer = newDrainer(ctx, m, sp, conf.MaxRetry, conf.RetryBaseDelay)
 	}
+	defaultManager = m
 	return defaultManager.Start()
 }
 
@@ -109,8 +158,9 @@ func CloseManager() {
 func (m *manager) Start() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	var endpoints []*config.Endpoint
 	for i := 0; i < len(m.eventServer); i++ {
-		h := handle{
+		h := &handle{
 			cacheChan: make(chan []byte, 100),
 			stop:      make(chan struct{}),
 			server:    m.eventServer[i],
@@ -119,14 +169,73 @@ func (m *manager) Start() error {
 		}
 		m.handles[m.eventServer[i]] = h
 		go h.HandleLog()
+		endpoints = append(endpoints, &config.Endpoint{Name: m.eventServer[i], URL: m.eventServer[i], Weight: 1})
 	}
+	m.lb.Update(endpoints)
 	if m.dis != nil {
 		m.dis.AddProject("event_log_event_grpc", m)
 	}
 	go m.GC()
+	go m.reportChanDepth()
+	go m.tenants.run(m.ctx, m)
+	go m.flushSuppressed()
+	if m.drainer != nil {
+		go m.drainer.run()
+	}
 	return nil
 }
 
+//pickChan 加锁获取一个发送chan，供tenantScheduler等manager之外的调用方使用
+func (m *manager) pickChan(eventID string) chan []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.getLBChan(eventID)
+}
+
+//SetRateLimit 动态调整某个event的限流速率和突发容量
+func (m *manager) SetRateLimit(eventID string, rps, burst int) {
+	m.rl.SetLimit(eventID, rps, burst)
+}
+
+//flushSuppressed 周期性地把被限流丢弃的消息合并成一条摘要日志重新投递，
+//让下游消费者至少能感知到"发生了丢失"，而不是静默无声
+func (m *manager) flushSuppressed() {
+	util.IntermittentExec(m.ctx, func() {
+		summaries := m.rl.flush()
+		for eventID, levels := range summaries {
+			for level, count := range levels {
+				if count == 0 {
+					continue
+				}
+				m.metrics.IncrCounterWithLabels([]string{"rainbond", "event", "ratelimit", "suppressed"}, float32(count), []Label{{Name: "event_id", Value: eventID}, {Name: "level", Value: string(level)}})
+				l, ok := m.GetLogger(eventID).(*logger)
+				if !ok {
+					continue
+				}
+				entry := LogEntry{
+					Level:   LevelInfo,
+					EventID: eventID,
+					Message: fmt.Sprintf("%d messages suppressed (level=%s)", count, level),
+				}
+				//摘要消息本身不能再经过限流检查，否则在持续超限时永远发不出去
+				l.deliver(entry)
+			}
+		}
+	}, time.Second)
+}
+
+//reportChanDepth 周期上报每个server对应handle的cacheChan积压深度
+func (m *manager) reportChanDepth() {
+	util.IntermittentExec(m.ctx, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for server, h := range m.handles {
+			m.metrics.SetGaugeWithLabels([]string{"rainbond", "event", "handle", "chan", "depth"}, float32(len(h.cacheChan)), []Label{{Name: "server", Value: server}})
+		}
+		m.metrics.SetGauge([]string{"rainbond", "event", "tenant", "queue", "dropped"}, float32(m.tenants.Dropped()))
+	}, time.Second*15)
+}
+
 func (m *manager) UpdateEndpoints(endpoints ...*config.Endpoint) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -136,12 +245,13 @@ func (m *manager) UpdateEndpoints(endpoints ...*config.Endpoint) {
 	logrus.Infof("Update event server endpoint,%+v", endpoints)
 	//清空不可用节点信息，以服务发现为主
 	m.abnormalServer = make(map[string]string)
+	m.lb.SetAbnormal(m.abnormalServer)
 	//增加新节点
 	var new = make(map[string]string)
 	for _, end := range endpoints {
 		new[end.URL] = end.URL
 		if _, ok := m.handles[end.URL]; !ok {
-			h := handle{
+			h := &handle{
 				cacheChan: make(chan []byte, 100),
 				stop:      make(chan struct{}),
 				server:    end.URL,
@@ -163,6 +273,10 @@ func (m *manager) UpdateEndpoints(endpoints ...*config.Endpoint) {
 		eventServer = append(eventServer, k)
 	}
 	m.eventServer = eventServer
+	//无论策略如何，每次endpoint变化都重建负载均衡状态（一致性hash环也在此重建）
+	m.lb.Update(endpoints)
+	m.metrics.SetGauge([]string{"rainbond", "event", "discover", "endpoints"}, float32(len(m.eventServer)))
+	m.metrics.SetGauge([]string{"rainbond", "event", "abnormal_server"}, float32(len(m.abnormalServer)))
 	logrus.Infof("update event handle core success,handle core count:%d, event server count:%d", len(m.handles), len(m.eventServer))
 
 }
@@ -171,11 +285,36 @@ func (m *manager) Error(err error) {
 
 }
 func (m *manager) Close() error {
+	if m.sp != nil {
+		//flush-before-exit：退出前给drainer一段时间把积压消息发送或转入死信，
+		//避免ctx被cancel后drainer提前退出导致WAL里还有未处理的记录
+		deadline := time.Now().Add(time.Second * 10)
+		for time.Now().Before(deadline) {
+			if m.sp.Stats().Queued == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
 	m.cancel()
 	m.dis.Stop()
+	if m.sp != nil {
+		m.sp.Close()
+	}
 	return nil
 }
 
+//Stats 返回落盘队列的积压情况，SpoolDir未设置时始终返回零值
+func (m *manager) Stats() Stats {
+	if m.sp == nil {
+		return Stats{}
+	}
+	stats := m.sp.Stats()
+	stats.InFlight = int(atomic.LoadInt32(&m.drainer.inFlight))
+	stats.Dead = int(atomic.LoadInt32(&m.drainer.dead))
+	return stats
+}
+
 func (m *manager) GC() {
 	util.IntermittentExec(m.ctx, func() {
 		m.lock.Lock()
@@ -192,6 +331,12 @@ func (m *manager) GC() {
 				logrus.Infof("start auto release event logger. %s", event)
 				delete(m.loggers, event)
 			}
+			m.metrics.IncrCounter([]string{"rainbond", "event", "logger", "gc"}, float32(len(needRelease)))
+		}
+		m.metrics.SetGauge([]string{"rainbond", "event", "logger", "active"}, float32(len(m.loggers)))
+		//rateLimiter的per-event令牌桶同样按1分钟未使用回收，否则随eventID数量（每次构建/部署都不同）无限增长
+		if released := m.rl.gc(time.Minute); released > 0 {
+			m.metrics.IncrCounter([]string{"rainbond", "event", "ratelimit", "gc"}, float32(released))
 		}
 	}, time.Second*20)
 }
@@ -209,8 +354,13 @@ func (m *manager) GetLogger(eventID string) Logger {
 	}
 	l := &logger{
 		event:      eventID,
-		sendChan:   m.getLBChan(),
+		sendChan:   m.getLBChan(eventID),
 		createTime: time.Now(),
+		sp:         m.sp,
+		schema:     m.config.Schema,
+		rl:         m.rl,
+		tenants:    m.tenants,
+		metrics:    m.metrics,
 	}
 	m.loggers[eventID] = l
 	return l
@@ -224,12 +374,22 @@ func (m *manager) ReleaseLogger(l Logger) {
 	}
 }
 
+//logStream HandleLog建立的gRPC日志发送流，抽出最小接口方便handle复用同一条连接
+type logStream interface {
+	Send(*eventpb.LogMessage) error
+	CloseSend() error
+}
+
 type handle struct {
 	server    string
 	stop      chan struct{}
 	cacheChan chan []byte
 	ctx       context.Context
 	manager   *manager
+	//mu 保护logClient/clientCancel，drainer的同步发送和HandleLog的异步发送循环共用同一条连接
+	mu           sync.Mutex
+	logClient    logStream
+	clientCancel context.CancelFunc
 }
 
 func (m *manager) DiscardedLoggerChan(cacheChan chan []byte) {
@@ -241,25 +401,22 @@ func (m *manager) DiscardedLoggerChan(cacheChan chan []byte) {
 			m.abnormalServer[k] = k
 		}
 	}
+	//只是把异常server标记给balancer跳过，不触发重建（一致性hash环保持不变）
+	m.lb.SetAbnormal(m.abnormalServer)
+	m.metrics.SetGauge([]string{"rainbond", "event", "abnormal_server"}, float32(len(m.abnormalServer)))
 	for _, v := range m.loggers {
 		if v.GetChan() == cacheChan {
-			v.SetChan(m.getLBChan())
+			v.SetChan(m.getLBChan(v.Event()))
 		}
 	}
 }
 
-func (m *manager) getLBChan() chan []byte {
-	for i := 0; i < len(m.eventServer); i++ {
-		index := m.qos % int32(len(m.eventServer))
-		m.qos = atomic.AddInt32(&(m.qos), 1)
-		server := m.eventServer[index]
-		if _, ok := m.abnormalServer[server]; ok {
-			continue
-		}
+func (m *manager) getLBChan(eventID string) chan []byte {
+	if server, ok := m.lb.Pick(eventID); ok {
 		if h, ok := m.handles[server]; ok {
 			return h.cacheChan
 		}
-		h := handle{
+		h := &handle{
 			cacheChan: make(chan []byte, 100),
 			stop:      make(chan struct{}),
 			server:    server,
@@ -284,37 +441,33 @@ func (m *manager) RemoveHandle(server string) {
 		delete(m.handles, server)
 	}
 }
+
+//getHandle 按server地址查找已建立的handle，供drainer复用既有连接而不是每条记录重新拨号
+func (m *manager) getHandle(server string) *handle {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.handles[server]
+}
 func (m *handle) HandleLog() error {
 	defer m.manager.RemoveHandle(m.server)
 	return util.Exec(m.ctx, func() error {
-		ctx, cancel := context.WithCancel(m.ctx)
-		defer cancel()
-		client, err := eventclient.NewEventClient(ctx, m.server)
-		if err != nil {
-			logrus.Error("create event client error.", err.Error())
-			return err
-		}
 		logrus.Infof("start a event log handle core. connect server %s", m.server)
-		logClient, err := client.Log(ctx)
-		if err != nil {
+		if err := m.connect(); err != nil {
 			logrus.Error("create event log client error.", err.Error())
 			//切换使用此chan的logger到其他chan
 			m.manager.DiscardedLoggerChan(m.cacheChan)
 			return err
 		}
+		defer m.closeClient()
 		for {
 			select {
 			case <-m.ctx.Done():
-				logClient.CloseSend()
 				return nil
 			case <-m.stop:
-				logClient.CloseSend()
 				return nil
 			case me := <-m.cacheChan:
-				err := logClient.Send(&eventpb.LogMessage{Log: me})
-				if err != nil {
+				if err := m.SendSync(me); err != nil {
 					logrus.Error("send event log error.", err.Error())
-					logClient.CloseSend()
 					//切换使用此chan的logger到其他chan
 					m.manager.DiscardedLoggerChan(m.cacheChan)
 					return nil
@@ -324,6 +477,70 @@ func (m *handle) HandleLog() error {
 	}, time.Second*3)
 }
 
+//connect 拨号建立（或重建）到m.server的持久日志流，替换handle当前持有的连接。
+//调用方不得持有m.mu
+func (m *handle) connect() error {
+	m.closeClient()
+	ctx, cancel := context.WithCancel(m.ctx)
+	client, err := eventclient.NewEventClient(ctx, m.server)
+	if err != nil {
+		cancel()
+		return err
+	}
+	logClient, err := client.Log(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	m.mu.Lock()
+	m.logClient = logClient
+	m.clientCancel = cancel
+	m.mu.Unlock()
+	return nil
+}
+
+//SendSync 通过本handle持有的持久连接发送一条消息，drainer和HandleLog的异步循环共用此方法，
+//避免每条消息都重新拨号建立连接；m.mu在Send调用期间保持持有，串行化对同一条gRPC流的并发写入。
+//发送失败说明这条流已经不可用，立即标记server异常并重新拨号，否则drainer后续的每一次重试
+//都会命中同一条已经断开的流，即使server已经恢复也永远无法自愈（只能等进程重启）
+func (m *handle) SendSync(payload []byte) error {
+	m.mu.Lock()
+	if m.logClient == nil {
+		m.mu.Unlock()
+		if err := m.connect(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+	}
+	client := m.logClient
+	start := time.Now()
+	sendErr := client.Send(&eventpb.LogMessage{Log: payload})
+	m.mu.Unlock()
+	m.manager.metrics.MeasureSinceWithLabels([]string{"rainbond", "event", "handle", "send", "latency"}, start, []Label{{Name: "server", Value: m.server}})
+	if sendErr != nil {
+		m.manager.metrics.IncrCounterWithLabels([]string{"rainbond", "event", "handle", "send", "errors"}, 1, []Label{{Name: "server", Value: m.server}})
+		m.manager.DiscardedLoggerChan(m.cacheChan)
+		if connErr := m.connect(); connErr != nil {
+			logrus.Error("reconnect event log client error.", connErr.Error())
+		}
+	}
+	return sendErr
+}
+
+//closeClient 关闭并清空本handle持有的连接，退出前或连接作废时调用
+func (m *handle) closeClient() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.logClient != nil {
+		m.logClient.CloseSend()
+		m.logClient = nil
+	}
+	if m.clientCancel != nil {
+		m.clientCancel()
+		m.clientCancel = nil
+	}
+}
+
 func (m *handle) Stop() {
 	close(m.stop)
 }
@@ -333,6 +550,8 @@ type Logger interface {
 	Info(string, map[string]string)
 	Error(string, map[string]string)
 	Debug(string, map[string]string)
+	//Log 发送一条结构化LogEntry，序列化格式由manager的EventConfig.Schema决定
+	Log(LogEntry)
 	Event() string
 	CreateTime() time.Time
 	GetChan() chan []byte
@@ -343,6 +562,16 @@ type logger struct {
 	event      string
 	sendChan   chan []byte
 	createTime time.Time
+	//sp 非空时send()落盘到WAL由drainer异步可靠投递，为空则保持原有内存直发行为
+	sp *spool
+	//schema 序列化协议版本，参见EventConfig.Schema
+	schema string
+	//rl 每个event独立的令牌桶限流器，超限消息被合并成周期摘要而不是直接丢弃
+	rl *rateLimiter
+	//tenants 租户公平调度器，sp为空且entry.TenantID非空时消息经此排队而不是直接投递
+	tenants *tenantScheduler
+	//metrics 指标上报，主要用于统计限流丢弃次数
+	metrics Metrics
 }
 
 func (l *logger) GetChan() chan []byte {
@@ -378,12 +607,99 @@ func (l *logger) Debug(message string, info map[string]string) {
 	info["level"] = "debug"
 	l.send(message, info)
 }
+//send 旧版Info/Error/Debug的公共实现，经由deliver统一序列化，
+//使EventConfig.Schema同样约束这条legacy路径而不是始终写死的flat map
 func (l *logger) send(message string, info map[string]string) {
-	info["event_id"] = l.event
-	info["message"] = message
-	info["time"] = time.Now().Format(time.RFC3339)
-	log, err := ffjson.Marshal(info)
-	if err == nil && l.sendChan != nil {
-		util.SendNoBlocking(log, l.sendChan)
+	level := Level(info["level"])
+	if l.rl != nil && !l.rl.Allow(l.event) {
+		l.rl.recordSuppressed(l.event, level)
+		l.metrics.IncrCounterWithLabels([]string{"rainbond", "event", "ratelimit", "dropped"}, 1, []Label{{Name: "event_id", Value: l.event}})
+		return
+	}
+	entry := LogEntry{
+		Level:   level,
+		EventID: l.event,
+		Message: message,
+	}
+	delete(info, "level")
+	if len(info) > 0 {
+		entry.Fields = make(map[string]interface{}, len(info))
+		for k, v := range info {
+			entry.Fields[k] = v
+		}
+	}
+	l.deliver(entry)
+}
+
+//Log 发送一条结构化LogEntry，SchemaV2下使用版本化envelope，否则退化为旧版flat map。
+//未开启SpoolDir且entry.TenantID非空时交给租户公平调度器排队，避免单租户突发流量饿死其他租户
+func (l *logger) Log(entry LogEntry) {
+	if l.rl != nil && !l.rl.Allow(l.event) {
+		l.rl.recordSuppressed(l.event, entry.Level)
+		l.metrics.IncrCounterWithLabels([]string{"rainbond", "event", "ratelimit", "dropped"}, 1, []Label{{Name: "event_id", Value: l.event}})
+		return
+	}
+	l.deliver(entry)
+}
+
+//deliver 跳过限流检查直接序列化并投递，供Log()和限流摘要消息自身复用
+func (l *logger) deliver(entry LogEntry) {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.EventID == "" {
+		entry.EventID = l.event
+	}
+	if err := validateEntry(entry); err != nil {
+		logrus.Error("invalid event log entry.", err.Error())
+		return
+	}
+	var payload []byte
+	var err error
+	if l.schema == SchemaV2 {
+		payload, err = ffjson.Marshal(v2Envelope{
+			V:         2,
+			Timestamp: entry.Timestamp,
+			Level:     entry.Level,
+			EventID:   entry.EventID,
+			Component: entry.Component,
+			Message:   entry.Message,
+			Duration:  entry.Duration,
+			Fields:    entry.Fields,
+			Request:   entry.Request,
+			TenantID:  entry.TenantID,
+		})
+	} else {
+		payload, err = ffjson.Marshal(entry.toFlatMap())
+	}
+	if err != nil {
+		logrus.Error("marshal event log entry error.", err.Error())
+		return
+	}
+	//sp非空时优先保证WAL可靠投递，租户公平调度只作用于未开启落盘的内存直发路径，
+	//否则tenantScheduler.run会绕过dispatch直接把payload塞进cacheChan，WAL重试/死信保证对该消息形同虚设
+	if l.sp != nil {
+		l.dispatch(entry.EventID, payload)
+		return
+	}
+	if l.tenants != nil && entry.TenantID != "" {
+		if !l.tenants.Enqueue(entry.TenantID, entry.EventID, payload) {
+			logrus.Warnf("tenant %s event log queue is full, drop message", entry.TenantID)
+		}
+		return
+	}
+	l.dispatch(entry.EventID, payload)
+}
+
+//dispatch 按是否开启了WAL落盘决定消息的去向，sp非空时走可靠投递，否则原样走内存直发chan
+func (l *logger) dispatch(eventID string, payload []byte) {
+	if l.sp != nil {
+		if _, err := l.sp.Append(eventID, payload); err != nil {
+			logrus.Error("append event log to spool error.", err.Error())
+		}
+		return
+	}
+	if l.sendChan != nil {
+		util.SendNoBlocking(payload, l.sendChan)
 	}
 }
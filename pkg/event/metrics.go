@@ -0,0 +1,50 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import "time"
+
+//Label 指标的一个维度标签，例如{Name:"server",Value:"127.0.0.1:6366"}
+type Label struct {
+	Name  string
+	Value string
+}
+
+//Metrics event内部状态的指标上报接口，形式参考armon/go-metrics，
+//key按"rainbond.event.xxx.yyy"的层级拆成字符串切片，由各Sink自行决定拼接方式
+type Metrics interface {
+	IncrCounter(key []string, val float32)
+	IncrCounterWithLabels(key []string, val float32, labels []Label)
+	SetGauge(key []string, val float32)
+	SetGaugeWithLabels(key []string, val float32, labels []Label)
+	MeasureSince(key []string, start time.Time)
+	MeasureSinceWithLabels(key []string, start time.Time, labels []Label)
+	AddSample(key []string, val float32)
+}
+
+//noopMetrics EventConfig.MetricsSink未设置时使用的空实现
+type noopMetrics struct{}
+
+func (noopMetrics) IncrCounter(key []string, val float32)                              {}
+func (noopMetrics) IncrCounterWithLabels(key []string, val float32, labels []Label)     {}
+func (noopMetrics) SetGauge(key []string, val float32)                                 {}
+func (noopMetrics) SetGaugeWithLabels(key []string, val float32, labels []Label)        {}
+func (noopMetrics) MeasureSince(key []string, start time.Time)                         {}
+func (noopMetrics) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {}
+func (noopMetrics) AddSample(key []string, val float32)                                {}
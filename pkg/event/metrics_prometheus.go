@@ -0,0 +1,139 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//PrometheusSink 把Metrics指标注册到prometheus默认Registry，
+//vec按指标名+标签名懒加载，同一指标名首次出现的标签集合决定了它的标签维度
+type PrometheusSink struct {
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+//NewPrometheusSink 创建一个PrometheusSink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		counters:   make(map[string]*prometheus.CounterVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+func metricName(key []string) string {
+	return strings.Join(key, "_")
+}
+
+func labelNames(labels []Label) []string {
+	names := make([]string, len(labels))
+	for i, l := range labels {
+		names[i] = l.Name
+	}
+	return names
+}
+
+func labelValues(labels []Label) prometheus.Labels {
+	values := make(prometheus.Labels, len(labels))
+	for _, l := range labels {
+		values[l.Name] = l.Value
+	}
+	return values
+}
+
+func (p *PrometheusSink) counterVec(key []string, labels []Label) *prometheus.CounterVec {
+	name := metricName(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, labelNames(labels))
+		prometheus.MustRegister(vec)
+		p.counters[name] = vec
+	}
+	return vec
+}
+
+func (p *PrometheusSink) gaugeVec(key []string, labels []Label) *prometheus.GaugeVec {
+	name := metricName(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, labelNames(labels))
+		prometheus.MustRegister(vec)
+		p.gauges[name] = vec
+	}
+	return vec
+}
+
+func (p *PrometheusSink) histogramVec(key []string, labels []Label) *prometheus.HistogramVec {
+	name := metricName(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.histograms[name]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name}, labelNames(labels))
+		prometheus.MustRegister(vec)
+		p.histograms[name] = vec
+	}
+	return vec
+}
+
+//IncrCounter 见Metrics
+func (p *PrometheusSink) IncrCounter(key []string, val float32) {
+	p.IncrCounterWithLabels(key, val, nil)
+}
+
+//IncrCounterWithLabels 见Metrics
+func (p *PrometheusSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	p.counterVec(key, labels).With(labelValues(labels)).Add(float64(val))
+}
+
+//SetGauge 见Metrics
+func (p *PrometheusSink) SetGauge(key []string, val float32) {
+	p.SetGaugeWithLabels(key, val, nil)
+}
+
+//SetGaugeWithLabels 见Metrics
+func (p *PrometheusSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	p.gaugeVec(key, labels).With(labelValues(labels)).Set(float64(val))
+}
+
+//MeasureSince 见Metrics
+func (p *PrometheusSink) MeasureSince(key []string, start time.Time) {
+	p.MeasureSinceWithLabels(key, start, nil)
+}
+
+//MeasureSinceWithLabels 见Metrics
+func (p *PrometheusSink) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	p.histogramVec(key, labels).With(labelValues(labels)).Observe(time.Since(start).Seconds())
+}
+
+//AddSample 见Metrics
+func (p *PrometheusSink) AddSample(key []string, val float32) {
+	p.histogramVec(key, nil).With(labelValues(nil)).Observe(float64(val))
+}
@@ -0,0 +1,110 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+//StatsdSink 通过UDP把Metrics指标以statsd协议投递给一个statsd agent
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+//NewStatsdSink 创建一个StatsdSink，addr形如"127.0.0.1:8125"
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{conn: conn, prefix: prefix}, nil
+}
+
+//statNameReplacer 把statsd协议保留字符（以及可能出现在server等label里的host:port分隔符）
+//替换成下划线，避免拼进stat name后破坏line protocol
+var statNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_", " ", "_")
+
+func (s *StatsdSink) statName(key []string, labels []Label) string {
+	var b strings.Builder
+	if s.prefix != "" {
+		b.WriteString(statNameReplacer.Replace(s.prefix))
+		b.WriteString(".")
+	}
+	for i, k := range key {
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(statNameReplacer.Replace(k))
+	}
+	for _, l := range labels {
+		b.WriteString(".")
+		b.WriteString(statNameReplacer.Replace(l.Name))
+		b.WriteString("_")
+		b.WriteString(statNameReplacer.Replace(l.Value))
+	}
+	return b.String()
+}
+
+func (s *StatsdSink) send(msg string) {
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		logrus.Warn("send statsd metric error.", err.Error())
+	}
+}
+
+//IncrCounter 见Metrics
+func (s *StatsdSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+//IncrCounterWithLabels 见Metrics
+func (s *StatsdSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.send(fmt.Sprintf("%s:%f|c\n", s.statName(key, labels), val))
+}
+
+//SetGauge 见Metrics
+func (s *StatsdSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+//SetGaugeWithLabels 见Metrics
+func (s *StatsdSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.send(fmt.Sprintf("%s:%f|g\n", s.statName(key, labels), val))
+}
+
+//MeasureSince 见Metrics
+func (s *StatsdSink) MeasureSince(key []string, start time.Time) {
+	s.MeasureSinceWithLabels(key, start, nil)
+}
+
+//MeasureSinceWithLabels 见Metrics
+func (s *StatsdSink) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	ms := float32(time.Since(start)) / float32(time.Millisecond)
+	s.send(fmt.Sprintf("%s:%f|ms\n", s.statName(key, labels), ms))
+}
+
+//AddSample 见Metrics
+func (s *StatsdSink) AddSample(key []string, val float32) {
+	s.send(fmt.Sprintf("%s:%f|ms\n", s.statName(key, nil), val))
+}
@@ -0,0 +1,189 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//defaultRateLimitRPS 每个event默认限速，消息/秒
+	defaultRateLimitRPS = 200
+	//defaultRateLimitBurst 默认突发容量
+	defaultRateLimitBurst = 400
+)
+
+//RateLimitConfig 单个event的令牌桶限流配置
+type RateLimitConfig struct {
+	RPS   int
+	Burst int
+}
+
+//tokenBucket 简单的令牌桶限流器，按需补充令牌而不是起定时器
+type tokenBucket struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+	//lastUsed 最近一次被访问的时间，供rateLimiter.gc判断是否可以回收
+	lastUsed time.Time
+}
+
+func newTokenBucket(rps, burst int) *tokenBucket {
+	if rps <= 0 {
+		rps = defaultRateLimitRPS
+	}
+	if burst <= 0 {
+		burst = defaultRateLimitBurst
+	}
+	now := time.Now()
+	return &tokenBucket{
+		rate:       float64(rps),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: now,
+		lastUsed:   now,
+	}
+}
+
+//Allow 尝试消费一个令牌，令牌不足时返回false
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.lastRefill).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastRefill = now
+	b.lastUsed = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//SetLimit 动态调整限速和突发容量
+func (b *tokenBucket) SetLimit(rps, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastUsed = time.Now()
+	if rps > 0 {
+		b.rate = float64(rps)
+	}
+	if burst > 0 {
+		b.burst = float64(burst)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+}
+
+//idleSince 返回该令牌桶距最近一次访问已经过去的时长
+func (b *tokenBucket) idleSince() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Since(b.lastUsed)
+}
+
+//rateLimiter 管理每个event id各自独立的令牌桶，超限的消息被合并成周期性摘要而不是静默丢弃
+type rateLimiter struct {
+	mu           sync.Mutex
+	defaultRPS   int
+	defaultBurst int
+	buckets      map[string]*tokenBucket
+	suppressed   map[string]map[Level]int
+}
+
+func newRateLimiter(conf RateLimitConfig) *rateLimiter {
+	rps, burst := conf.RPS, conf.Burst
+	if rps <= 0 {
+		rps = defaultRateLimitRPS
+	}
+	if burst <= 0 {
+		burst = defaultRateLimitBurst
+	}
+	return &rateLimiter{
+		defaultRPS:   rps,
+		defaultBurst: burst,
+		buckets:      make(map[string]*tokenBucket),
+		suppressed:   make(map[string]map[Level]int),
+	}
+}
+
+func (r *rateLimiter) bucket(eventID string) *tokenBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[eventID]
+	if !ok {
+		b = newTokenBucket(r.defaultRPS, r.defaultBurst)
+		r.buckets[eventID] = b
+	}
+	return b
+}
+
+//Allow 判断某个event这一条消息是否允许通过限流
+func (r *rateLimiter) Allow(eventID string) bool {
+	return r.bucket(eventID).Allow()
+}
+
+//SetLimit 为某个event单独设置限速，供manager.SetRateLimit做动态调优
+func (r *rateLimiter) SetLimit(eventID string, rps, burst int) {
+	r.bucket(eventID).SetLimit(rps, burst)
+}
+
+//recordSuppressed 记录一条被限流丢弃的消息，按event id和level分别计数
+func (r *rateLimiter) recordSuppressed(eventID string, level Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	levels, ok := r.suppressed[eventID]
+	if !ok {
+		levels = make(map[Level]int)
+		r.suppressed[eventID] = levels
+	}
+	levels[level]++
+}
+
+//flush 取出并清空当前累计的抑制计数，用于周期生成"N messages suppressed"摘要
+func (r *rateLimiter) flush() map[string]map[Level]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.suppressed
+	r.suppressed = make(map[string]map[Level]int)
+	return out
+}
+
+//gc 回收超过idle时长未被访问的令牌桶及其抑制计数，避免per-event的bucket随eventID数量无限增长，
+//对齐manager.loggers按1分钟未使用GC的做法
+func (r *rateLimiter) gc(idle time.Duration) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var released int
+	for eventID, b := range r.buckets {
+		if b.idleSince() >= idle {
+			delete(r.buckets, eventID)
+			delete(r.suppressed, eventID)
+			released++
+		}
+	}
+	return released
+}
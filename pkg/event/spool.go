@@ -0,0 +1,296 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentFile = "spool.log"
+	spoolCursorFile  = "spool.cursor"
+	spoolDeadFile    = "spool.dead"
+)
+
+//Record 一条落盘的待发送日志，Seq为单调递增序号，用于WAL游标定位
+type Record struct {
+	Seq     uint64
+	EventID string
+	Payload []byte
+	Attempt int
+	NextTry time.Time
+}
+
+//spool 基于文件分段的WAL，保证gRPC全部异常时日志不丢失
+//落盘顺序：Append写入segment并立即加入内存待发队列，
+//drainer成功发送后调用Ack推进游标，连续重试失败的记录由DeadLetter归档
+type spool struct {
+	dir        string
+	mu         sync.Mutex
+	seq        uint64
+	acked      uint64
+	segment    *os.File
+	deadLetter *os.File
+	pending    []*Record
+}
+
+//newSpool 打开（或创建）dir下的WAL文件并回放未被确认的记录
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sp := &spool{dir: dir}
+	acked, err := sp.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	sp.acked = acked
+	maxSeq, err := sp.replay()
+	if err != nil {
+		return nil, err
+	}
+	//seq必须从segment中已出现的最大值继续，否则崩溃重启后、acked之后还有未确认记录时，
+	//下一次Append会复用已经用过的Seq，造成重复投递
+	sp.seq = acked
+	if maxSeq > sp.seq {
+		sp.seq = maxSeq
+	}
+	segment, err := os.OpenFile(filepath.Join(dir, spoolSegmentFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sp.segment = segment
+	dead, err := os.OpenFile(filepath.Join(dir, spoolDeadFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sp.deadLetter = dead
+	return sp, nil
+}
+
+func (sp *spool) cursorPath() string {
+	return filepath.Join(sp.dir, spoolCursorFile)
+}
+
+func (sp *spool) readCursor() (uint64, error) {
+	data, err := ioutil.ReadFile(sp.cursorPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	acked, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return acked, nil
+}
+
+//writeCursor 原子落盘游标，避免进程被杀时写出半截文件
+func (sp *spool) writeCursor() error {
+	tmp := sp.cursorPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(sp.acked, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sp.cursorPath())
+}
+
+//replay 重启时从segment中恢复游标之后、尚未确认的记录，并返回segment中出现过的最大Seq，
+//供newSpool用来接续sp.seq，避免游标之后还有未确认记录时重启复用旧Seq
+func (sp *spool) replay() (uint64, error) {
+	var maxSeq uint64
+	f, err := os.Open(filepath.Join(sp.dir, spoolSegmentFile))
+	if os.IsNotExist(err) {
+		return maxSeq, nil
+	}
+	if err != nil {
+		return maxSeq, err
+	}
+	defer f.Close()
+	for {
+		rec, err := readRecord(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//segment尾部写坏（进程在写入中途被杀），忽略剩余部分
+			break
+		}
+		if rec.Seq > maxSeq {
+			maxSeq = rec.Seq
+		}
+		if rec.Seq > sp.acked {
+			sp.pending = append(sp.pending, rec)
+		}
+	}
+	return maxSeq, nil
+}
+
+func writeRecord(w io.Writer, rec *Record) error {
+	if err := binary.Write(w, binary.BigEndian, rec.Seq); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(rec.EventID))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(rec.EventID)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(rec.Payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(rec.Payload)
+	return err
+}
+
+func readRecord(r io.Reader) (*Record, error) {
+	rec := &Record{}
+	if err := binary.Read(r, binary.BigEndian, &rec.Seq); err != nil {
+		return nil, err
+	}
+	var eventIDLen uint32
+	if err := binary.Read(r, binary.BigEndian, &eventIDLen); err != nil {
+		return nil, err
+	}
+	eventID := make([]byte, eventIDLen)
+	if _, err := io.ReadFull(r, eventID); err != nil {
+		return nil, err
+	}
+	rec.EventID = string(eventID)
+	var payloadLen uint32
+	if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	rec.Payload = payload
+	return rec, nil
+}
+
+//Append 写入一条新记录并加入待发队列，返回记录本身供调用方（drainer）后续投递
+func (sp *spool) Append(eventID string, payload []byte) (*Record, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.seq++
+	rec := &Record{Seq: sp.seq, EventID: eventID, Payload: payload}
+	if err := writeRecord(sp.segment, rec); err != nil {
+		return nil, err
+	}
+	if err := sp.segment.Sync(); err != nil {
+		return nil, err
+	}
+	sp.pending = append(sp.pending, rec)
+	return rec, nil
+}
+
+//Head 返回待发队列队首记录，不出队；队列为空返回false
+func (sp *spool) Head() (*Record, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(sp.pending) == 0 {
+		return nil, false
+	}
+	return sp.pending[0], true
+}
+
+//Ack 确认队首记录已成功发送，出队并推进落盘游标
+func (sp *spool) Ack(seq uint64) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(sp.pending) == 0 || sp.pending[0].Seq != seq {
+		return fmt.Errorf("event: spool ack seq %d is not head of queue", seq)
+	}
+	sp.pending = sp.pending[1:]
+	sp.acked = seq
+	return sp.writeCursor()
+}
+
+//DeadLetter 放弃队首记录的重试，归档到死信文件后出队
+func (sp *spool) DeadLetter(seq uint64) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(sp.pending) == 0 || sp.pending[0].Seq != seq {
+		return fmt.Errorf("event: spool dead-letter seq %d is not head of queue", seq)
+	}
+	rec := sp.pending[0]
+	if err := writeRecord(sp.deadLetter, rec); err != nil {
+		return err
+	}
+	if err := sp.deadLetter.Sync(); err != nil {
+		return err
+	}
+	sp.pending = sp.pending[1:]
+	sp.acked = seq
+	return sp.writeCursor()
+}
+
+//Stats 返回当前WAL的积压情况
+func (sp *spool) Stats() Stats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return Stats{Queued: len(sp.pending)}
+}
+
+//Close 关闭底层文件；游标已在每次Ack/DeadLetter时落盘，这里不再写入
+func (sp *spool) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.segment != nil {
+		sp.segment.Close()
+	}
+	if sp.deadLetter != nil {
+		sp.deadLetter.Close()
+	}
+	return nil
+}
+
+//ReplayDeadLetters 读取死信文件中的记录供运维侧重新投递，不修改死信文件本身
+func ReplayDeadLetters(dir string) ([]*Record, error) {
+	f, err := os.Open(filepath.Join(dir, spoolDeadFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*Record
+	for {
+		rec, err := readRecord(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			break
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
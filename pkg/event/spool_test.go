@@ -0,0 +1,125 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestSpool(t *testing.T) (*spool, string) {
+	dir, err := ioutil.TempDir("", "event-spool-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	sp, err := newSpool(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("newSpool: %v", err)
+	}
+	return sp, dir
+}
+
+func TestSpoolAppendHeadAck(t *testing.T) {
+	sp, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+	defer sp.Close()
+
+	rec1, err := sp.Append("event-1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if rec1.Seq != 1 {
+		t.Fatalf("expected first record seq 1, got %d", rec1.Seq)
+	}
+	rec2, err := sp.Append("event-1", []byte("world"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if rec2.Seq != 2 {
+		t.Fatalf("expected second record seq 2, got %d", rec2.Seq)
+	}
+	if stats := sp.Stats(); stats.Queued != 2 {
+		t.Fatalf("expected 2 queued records, got %d", stats.Queued)
+	}
+	head, ok := sp.Head()
+	if !ok || head.Seq != rec1.Seq {
+		t.Fatalf("expected head to be seq %d, got %+v (ok=%v)", rec1.Seq, head, ok)
+	}
+	if err := sp.Ack(rec1.Seq); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	head, ok = sp.Head()
+	if !ok || head.Seq != rec2.Seq {
+		t.Fatalf("expected head to advance to seq %d, got %+v (ok=%v)", rec2.Seq, head, ok)
+	}
+}
+
+//TestSpoolReplayAfterCrashDoesNotReuseSeq 模拟进程在>=2条记录未确认时崩溃重启：
+//newSpool必须从segment里实际出现过的最大Seq继续，而不是从acked游标继续，
+//否则重启后的下一次Append会复用已经写过的Seq，造成重复投递
+func TestSpoolReplayAfterCrashDoesNotReuseSeq(t *testing.T) {
+	sp, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := sp.Append("event-1", []byte("a")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if _, err := sp.Append("event-1", []byte("b")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if _, err := sp.Append("event-1", []byte("c")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	// 只确认第一条，模拟进程在后面两条还未被drainer确认时被杀
+	if err := sp.Ack(1); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	sp.Close()
+
+	restarted, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("newSpool after restart: %v", err)
+	}
+	defer restarted.Close()
+
+	pendingSeqs := make(map[uint64]bool)
+	for {
+		rec, ok := restarted.Head()
+		if !ok {
+			break
+		}
+		pendingSeqs[rec.Seq] = true
+		if err := restarted.Ack(rec.Seq); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+	}
+	if !pendingSeqs[2] || !pendingSeqs[3] {
+		t.Fatalf("expected replayed pending seqs 2 and 3 to survive restart, got %v", pendingSeqs)
+	}
+
+	next, err := restarted.Append("event-1", []byte("d"))
+	if err != nil {
+		t.Fatalf("append after restart: %v", err)
+	}
+	if next.Seq != 4 {
+		t.Fatalf("expected seq after restart to continue from max replayed seq (4), got %d", next.Seq)
+	}
+}
@@ -0,0 +1,130 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goodrain/rainbond/pkg/util"
+	"golang.org/x/net/context"
+)
+
+//defaultTenantQueueSize 单个租户有界队列的容量
+const defaultTenantQueueSize = 256
+
+//tenantMsg 经过租户调度器排队、等待投递到某个event log server的一条消息
+type tenantMsg struct {
+	eventID string
+	payload []byte
+}
+
+//tenantQueue 单个租户的有界队列，以及平滑加权轮询所需的权重状态
+type tenantQueue struct {
+	ch            chan *tenantMsg
+	weight        int
+	currentWeight int
+}
+
+//tenantScheduler 在getLBChan之前按租户做公平调度：
+//每个TenantID拥有独立的有界队列，使用nginx风格平滑加权轮询选出下一个出队的租户，
+//避免单个租户的突发日志占满所有handle的cacheChan而饿死其他租户
+type tenantScheduler struct {
+	mu      sync.Mutex
+	queues  map[string]*tenantQueue
+	dropped int64
+}
+
+func newTenantScheduler() *tenantScheduler {
+	return &tenantScheduler{queues: make(map[string]*tenantQueue)}
+}
+
+func (s *tenantScheduler) queueFor(tenantID string) *tenantQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[tenantID]
+	if !ok {
+		q = &tenantQueue{ch: make(chan *tenantMsg, defaultTenantQueueSize), weight: 1}
+		s.queues[tenantID] = q
+	}
+	return q
+}
+
+//Enqueue 把一条消息放入租户对应的队列，队列已满时丢弃并计数，调用方不会被阻塞
+func (s *tenantScheduler) Enqueue(tenantID, eventID string, payload []byte) bool {
+	q := s.queueFor(tenantID)
+	select {
+	case q.ch <- &tenantMsg{eventID: eventID, payload: payload}:
+		return true
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return false
+	}
+}
+
+//pick 平滑加权轮询选出一个当前有待发消息的租户队列，所有队列为空时返回nil
+func (s *tenantScheduler) pick() *tenantQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *tenantQueue
+	total := 0
+	for _, q := range s.queues {
+		if len(q.ch) == 0 {
+			continue
+		}
+		q.currentWeight += q.weight
+		total += q.weight
+		if best == nil || q.currentWeight > best.currentWeight {
+			best = q
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+//Dropped 返回因队列已满而被丢弃的消息总数
+func (s *tenantScheduler) Dropped() int {
+	return int(atomic.LoadInt64(&s.dropped))
+}
+
+//run 持续按公平调度结果把各租户队列中的消息转发到manager选出的gRPC发送chan
+func (s *tenantScheduler) run(ctx context.Context, m *manager) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		q := s.pick()
+		if q == nil {
+			time.Sleep(time.Millisecond * 20)
+			continue
+		}
+		select {
+		case msg := <-q.ch:
+			if ch := m.pickChan(msg.eventID); ch != nil {
+				util.SendNoBlocking(msg.payload, ch)
+			}
+		default:
+		}
+	}
+}